@@ -0,0 +1,194 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"golang.org/x/oauth2/clientcredentials"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	oauthCfgSecretFieldGrantType    = "grantType"
+	oauthCfgSecretFieldScopes       = "scopes"
+	oauthGrantTypeClientCredentials = "client_credentials"
+
+	// M2MTokenPath is the path the OAuth service's router must mount M2MController's ServeHTTP on.
+	M2MTokenPath = "/m2m/token"
+)
+
+// m2mConfigFromSecret builds the clientcredentials.Config for the machine-to-machine OAuth flow out of an
+// OAuth config secret that declares the client_credentials grant type.
+func m2mConfigFromSecret(secret *v1.Secret) (*clientcredentials.Config, error) {
+	if grantType := string(secret.Data[oauthCfgSecretFieldGrantType]); grantType != oauthGrantTypeClientCredentials {
+		return nil, fmt.Errorf("the OAuth config secret does not declare the %s grant type", oauthGrantTypeClientCredentials)
+	}
+
+	clientId := string(secret.Data[oauthCfgSecretFieldClientId])
+	clientSecret := string(secret.Data[oauthCfgSecretFieldClientSecret])
+	if clientId == "" || clientSecret == "" {
+		return nil, fmt.Errorf("the OAuth config secret is missing the %s or %s field", oauthCfgSecretFieldClientId, oauthCfgSecretFieldClientSecret)
+	}
+
+	tokenUrl := string(secret.Data[oauthCfgSecretFieldTokenUrl])
+	if tokenUrl == "" {
+		return nil, fmt.Errorf("the OAuth config secret is missing the %s field required for the %s grant", oauthCfgSecretFieldTokenUrl, oauthGrantTypeClientCredentials)
+	}
+
+	var scopes []string
+	if raw := string(secret.Data[oauthCfgSecretFieldScopes]); raw != "" {
+		scopes = strings.Split(raw, ",")
+	}
+
+	return &clientcredentials.Config{
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		TokenURL:     tokenUrl,
+		Scopes:       scopes,
+	}, nil
+}
+
+// m2mTokenRequest is the JSON body expected by the M2MController's POST /m2m/token endpoint.
+type m2mTokenRequest struct {
+	Assertion           string                     `json:"assertion"`
+	TargetNamespace     string                     `json:"targetNamespace"`
+	TargetTokenName     string                     `json:"targetTokenName"`
+	ServiceProviderType config.ServiceProviderType `json:"serviceProviderType"`
+}
+
+// M2MController serves the client_credentials OAuth flow for non-interactive callers (CI systems, other
+// controllers, ...) that cannot complete a browser-based authorization-code exchange. The caller
+// authenticates with a caller-provided JWT assertion instead of a human redirect.
+//
+// Construct it with NewM2MController and expose it by calling RegisterRoutes on the OAuth service's
+// *http.ServeMux, rather than building the struct literal directly, so that a missing VerifyAssertion is
+// caught at startup instead of on the first request.
+type M2MController struct {
+	commonController
+	TokenStorage tokenstorage.TokenStorage
+
+	// VerifyAssertion validates the caller-supplied assertion and returns the single namespace it
+	// authorizes minting a token for. This is the only thing that can legitimately restrict a request to
+	// one namespace: the OAuth config secret itself is already looked up with client.InNamespace(
+	// TargetNamespace), so a namespace label on the secret can never catch a caller asking for a namespace
+	// other than the one its own secret lives in.
+	VerifyAssertion func(assertion string) (namespace string, err error)
+}
+
+// NewM2MController builds an M2MController, rejecting a nil verifyAssertion up front so that a
+// misconfigured deployment fails fast at startup rather than panicking on the first request.
+func NewM2MController(common commonController, tokenStorage tokenstorage.TokenStorage, verifyAssertion func(assertion string) (string, error)) (*M2MController, error) {
+	if verifyAssertion == nil {
+		return nil, fmt.Errorf("VerifyAssertion must be set")
+	}
+
+	return &M2MController{
+		commonController: common,
+		TokenStorage:     tokenStorage,
+		VerifyAssertion:  verifyAssertion,
+	}, nil
+}
+
+// RegisterRoutes mounts the M2MController's POST /m2m/token endpoint on mux.
+func (m *M2MController) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle(M2MTokenPath, m)
+}
+
+func (m *M2MController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.VerifyAssertion == nil {
+		http.Error(w, "the M2M controller is not configured with an assertion verifier", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqBody := m2mTokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	allowedNamespace, err := m.VerifyAssertion(reqBody.Assertion)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid assertion: %s", err), http.StatusUnauthorized)
+		return
+	}
+	if allowedNamespace != reqBody.TargetNamespace {
+		http.Error(w, "the assertion does not authorize minting a token for the requested namespace", http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+
+	oauthInfo := &oauthstate.OAuthInfo{
+		TokenNamespace:      reqBody.TargetNamespace,
+		ServiceProviderType: reqBody.ServiceProviderType,
+	}
+
+	found, secret, err := m.findOauthConfigSecret(ctx, oauthInfo)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to look up the OAuth config secret: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "no matching OAuth config secret found", http.StatusNotFound)
+		return
+	}
+
+	m2mCfg, err := m2mConfigFromSecret(secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := m2mCfg.Token(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to perform the client_credentials exchange: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	spiToken := &v1beta1.SPIAccessToken{}
+	if err := m.K8sClient.Get(ctx, client.ObjectKey{Namespace: reqBody.TargetNamespace, Name: reqBody.TargetTokenName}, spiToken); err != nil {
+		http.Error(w, fmt.Sprintf("failed to look up the target SPIAccessToken: %s", err), http.StatusNotFound)
+		return
+	}
+
+	// token.Expiry is the zero time.Time when the provider didn't return an expires_in (common for the
+	// client_credentials grant), and its Unix() is a large negative number that would wrap into a bogus,
+	// far-future uint64 below, so it must be special-cased to 0 instead of being converted blindly.
+	var expiry uint64
+	if !token.Expiry.IsZero() {
+		expiry = uint64(token.Expiry.Unix())
+	}
+
+	if err := m.TokenStorage.Store(ctx, spiToken, &tokenstorage.Token{AccessToken: token.AccessToken, Expiry: expiry}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store the obtained token: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
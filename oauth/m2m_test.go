@@ -0,0 +1,70 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestM2MControllerServeHTTPRejectsNamespaceTheAssertionDoesNotAuthorize(t *testing.T) {
+	ctrl, err := NewM2MController(commonController{}, nil, func(string) (string, error) { return "namespace-a", nil })
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, M2MTokenPath, strings.NewReader(`{"targetNamespace": "namespace-b"}`))
+	rec := httptest.NewRecorder()
+
+	ctrl.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestNewM2MControllerRejectsMissingVerifyAssertion(t *testing.T) {
+	ctrl, err := NewM2MController(commonController{}, nil, nil)
+	assert.Error(t, err)
+	assert.Nil(t, ctrl)
+}
+
+func TestM2MControllerServeHTTPGuardsNilVerifyAssertion(t *testing.T) {
+	// Simulates a controller built without going through NewM2MController.
+	ctrl := &M2MController{}
+
+	req := httptest.NewRequest(http.MethodPost, M2MTokenPath, strings.NewReader("{}"))
+	rec := httptest.NewRecorder()
+
+	ctrl.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestM2MControllerRegisterRoutesMountsThePath(t *testing.T) {
+	ctrl, err := NewM2MController(commonController{}, nil, func(string) (string, error) { return "", nil })
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	ctrl.RegisterRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodGet, M2MTokenPath, nil)
+	rec := httptest.NewRecorder()
+
+	mux.ServeHTTP(rec, req)
+
+	// Routed to the controller (which rejects non-POST), rather than falling through to a 404.
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,77 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+const (
+	oauthCfgSecretFieldClientCert = "clientCert"
+	oauthCfgSecretFieldClientKey  = "clientKey"
+)
+
+// mtlsClientCacheKey memoizes the *http.Client built for a client certificate. The certificate/key
+// fingerprint is part of the key on purpose: a Kyma issue this is modeled on had a real bug where the
+// cache key missed that component and kept serving a stale client (with the old, rotated-out certificate)
+// after the secret was updated.
+type mtlsClientCacheKey struct {
+	namespace           string
+	serviceProviderType config.ServiceProviderType
+	certFingerprint     string
+}
+
+var mtlsClientCache sync.Map // map[mtlsClientCacheKey]*http.Client
+
+// mtlsHTTPClient returns an *http.Client configured to present the given client certificate, memoized per
+// namespace, service provider type and certificate/key fingerprint so that rotating the certificate always
+// produces a fresh client instead of silently reusing the old one.
+func mtlsHTTPClient(namespace string, spType config.ServiceProviderType, certPEM []byte, keyPEM []byte) (*http.Client, error) {
+	key := mtlsClientCacheKey{
+		namespace:           namespace,
+		serviceProviderType: spType,
+		certFingerprint:     fingerprintCertAndKey(certPEM, keyPEM),
+	}
+
+	if cached, ok := mtlsClientCache.Load(key); ok {
+		return cached.(*http.Client), nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the client certificate/key pair: %w", err)
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		},
+	}
+
+	actual, _ := mtlsClientCache.LoadOrStore(key, httpClient)
+	return actual.(*http.Client), nil
+}
+
+func fingerprintCertAndKey(certPEM []byte, keyPEM []byte) string {
+	sum := sha256.Sum256(append(append([]byte{}, certPEM...), keyPEM...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func generateTestCertAndKey(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	assert.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	assert.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+
+	return certPEM, keyPEM
+}
+
+func TestMtlsHTTPClientCacheKeyIncludesCertificate(t *testing.T) {
+	cert1, key1 := generateTestCertAndKey(t, "client-1")
+	cert2, key2 := generateTestCertAndKey(t, "client-2")
+
+	client1, err := mtlsHTTPClient("ns", config.ServiceProviderTypeGitHub, cert1, key1)
+	assert.NoError(t, err)
+
+	client2, err := mtlsHTTPClient("ns", config.ServiceProviderTypeGitHub, cert2, key2)
+	assert.NoError(t, err)
+
+	assert.NotSame(t, client1, client2, "rotating the certificate must invalidate the cached client")
+
+	client1Again, err := mtlsHTTPClient("ns", config.ServiceProviderTypeGitHub, cert1, key1)
+	assert.NoError(t, err)
+	assert.Same(t, client1, client1Again, "the same certificate should be served from the cache")
+}
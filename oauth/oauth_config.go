@@ -0,0 +1,296 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/bitbucket"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	oauthCfgSecretFieldClientId     = "clientId"
+	oauthCfgSecretFieldClientSecret = "clientSecret"
+	oauthCfgSecretFieldAuthUrl      = "authUrl"
+	oauthCfgSecretFieldTokenUrl     = "tokenUrl"
+
+	// oauthCfgSecretFieldJwksUrl lets an OIDC OAuth config secret that also sets authUrl/tokenUrl (and so
+	// skips discovery entirely) still declare its JWKS URL explicitly, since that URL cannot be derived
+	// from the issuer URL by convention.
+	oauthCfgSecretFieldJwksUrl = "jwksUrl"
+
+	// oauthCfgSecretLabelHost lets a cluster host OAuth config for more than one instance of the same
+	// service provider type (e.g. github.com and a GitHub Enterprise install) by labelling each secret
+	// with the host it applies to. A secret without this label is the default, used when no other secret
+	// matches the host more specifically.
+	oauthCfgSecretLabelHost = "spi.appstudio.redhat.com/service-provider-host"
+)
+
+// commonController is the shared implementation of the OAuth flow endpoints used by all the service
+// providers. The service-provider specific bits (the default OAuth endpoint, the base URL of the OAuth
+// service, ...) are injected through the fields below.
+type commonController struct {
+	Config    config.ServiceProviderConfiguration
+	K8sClient client.Client
+	Endpoint  oauth2.Endpoint
+	BaseUrl   string
+}
+
+// initializeConfigFromSecret fills in the client id, client secret and, if present, the auth and token
+// URLs of the oauthCfg from the data of the given secret. It is an error for the secret to not contain
+// the client id or client secret.
+func initializeConfigFromSecret(secret *v1.Secret, oauthCfg *oauth2.Config) error {
+	clientId, ok := secret.Data[oauthCfgSecretFieldClientId]
+	if !ok || len(clientId) == 0 {
+		return fmt.Errorf("the OAuth config secret is missing the %s field", oauthCfgSecretFieldClientId)
+	}
+
+	clientSecret, ok := secret.Data[oauthCfgSecretFieldClientSecret]
+	if !ok || len(clientSecret) == 0 {
+		return fmt.Errorf("the OAuth config secret is missing the %s field", oauthCfgSecretFieldClientSecret)
+	}
+
+	oauthCfg.ClientID = string(clientId)
+	oauthCfg.ClientSecret = string(clientSecret)
+	oauthCfg.Endpoint.AuthURL = string(secret.Data[oauthCfgSecretFieldAuthUrl])
+	oauthCfg.Endpoint.TokenURL = string(secret.Data[oauthCfgSecretFieldTokenUrl])
+
+	return nil
+}
+
+// findOauthConfigSecret looks up the Secret that carries the OAuth client configuration for the service
+// provider and namespace identified by oauthInfo. It returns false, nil, nil when no such secret exists so
+// that the caller can fall back to the statically configured client id/secret instead of treating this as
+// an error. When more than one secret matches the service provider type, the one labelled with the most
+// specific match for oauthInfo.ServiceProviderUrl's host wins (exact host > wildcard host > unlabelled
+// default); ties between equally-specific secrets are reported as an error rather than silently picked.
+func (c commonController) findOauthConfigSecret(ctx context.Context, oauthInfo *oauthstate.OAuthInfo) (bool, *v1.Secret, error) {
+	secrets := &v1.SecretList{}
+	if err := c.K8sClient.List(ctx, secrets,
+		client.InNamespace(oauthInfo.TokenNamespace),
+		client.MatchingLabels{v1beta1.ServiceProviderTypeLabel: string(oauthInfo.ServiceProviderType)}); err != nil {
+		if apierrors.IsForbidden(err) {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+
+	if len(secrets.Items) == 0 {
+		return false, nil, nil
+	}
+
+	return selectOauthConfigSecret(secrets.Items, oauthInfo.ServiceProviderUrl)
+}
+
+// selectOauthConfigSecret picks the most specific of the candidate secrets for serviceProviderUrl: an
+// exact match of the oauthCfgSecretLabelHost label against the URL's host wins over a "*.example.com"
+// wildcard match, which in turn wins over an unlabelled, default secret. Multiple equally-specific matches
+// are an error, since there's no safe way to pick between them without risking leaking one tenant's client
+// credentials into another tenant's flow.
+func selectOauthConfigSecret(secrets []v1.Secret, serviceProviderUrl string) (bool, *v1.Secret, error) {
+	host := ""
+	if parsed, err := url.Parse(serviceProviderUrl); err == nil {
+		host = parsed.Host
+	}
+
+	var exact, wildcard, byDefault []*v1.Secret
+
+	for i := range secrets {
+		hostLabel := secrets[i].Labels[oauthCfgSecretLabelHost]
+		switch {
+		case hostLabel == "":
+			byDefault = append(byDefault, &secrets[i])
+		case hostLabel == host:
+			exact = append(exact, &secrets[i])
+		case strings.HasPrefix(hostLabel, "*.") && host != "" && strings.HasSuffix(host, hostLabel[1:]):
+			wildcard = append(wildcard, &secrets[i])
+		}
+	}
+
+	for _, candidates := range [][]*v1.Secret{exact, wildcard, byDefault} {
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			return true, candidates[0], nil
+		default:
+			return false, nil, fmt.Errorf("multiple equally specific OAuth config secrets match host %q", host)
+		}
+	}
+
+	return false, nil, nil
+}
+
+// VerifiedOauthConfig is an oauth2.Config enriched with the TokenVerifier that downstream code should use
+// to check the trust of any token obtained through it, uniformly across service provider types, and,
+// optionally, the *http.Client to use for the exchange when the service provider requires mTLS client
+// authentication.
+type VerifiedOauthConfig struct {
+	oauth2.Config
+	Verifier   TokenVerifier
+	HTTPClient *http.Client
+}
+
+// Context returns ctx with the VerifiedOauthConfig's HTTPClient installed for use by oauth2, if one is
+// configured (e.g. for mTLS client authentication). Callers should use the returned context for
+// oauthCfg.Exchange and similar oauth2 calls instead of the plain ctx.
+func (c *VerifiedOauthConfig) Context(ctx context.Context) context.Context {
+	if c.HTTPClient == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, c.HTTPClient)
+}
+
+// obtainOauthConfig builds the oauth2.Config to use for the OAuth flow identified by oauthInfo. It prefers
+// the client id/secret (and, if present, the auth/token URLs) found in a matching Secret over the
+// statically configured ones, and falls back to the service provider's default OAuth endpoint when the
+// secret doesn't override it.
+func (c commonController) obtainOauthConfig(ctx context.Context, oauthInfo *oauthstate.OAuthInfo) (*VerifiedOauthConfig, error) {
+	oauthCfg := &oauth2.Config{
+		RedirectURL: c.redirectUrl(),
+	}
+
+	found, secret, err := c.findOauthConfigSecret(ctx, oauthInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		if err := initializeConfigFromSecret(secret, oauthCfg); err != nil {
+			return nil, err
+		}
+	} else {
+		oauthCfg.ClientID = c.Config.ClientId
+		oauthCfg.ClientSecret = c.Config.ClientSecret
+	}
+
+	if oauthCfg.Endpoint == (oauth2.Endpoint{}) {
+		oauthCfg.Endpoint = c.Endpoint
+	}
+
+	// Bitbucket doesn't have a fixed on-prem/cloud endpoint configured ahead of time the way GitHub or
+	// Quay do, so fall back to the well-known bitbucket.org endpoint unless the secret or the static
+	// config already supplied one (e.g. for a self-hosted Bitbucket Server instance).
+	if oauthCfg.Endpoint == (oauth2.Endpoint{}) && c.Config.ServiceProviderType == config.ServiceProviderTypeBitbucket {
+		oauthCfg.Endpoint = bitbucket.Endpoint
+	}
+
+	// The JWKS URL cannot be derived from the issuer URL by convention (Keycloak, Okta and Dex all serve it
+	// at different, provider-specific paths), so for OIDC it must come from either an explicit secret
+	// override or the discovery document - never be synthesized.
+	var jwksUrl string
+	if c.Config.ServiceProviderType == config.ServiceProviderTypeOIDC && found {
+		if secretJwksUrl := secret.Data[oauthCfgSecretFieldJwksUrl]; len(secretJwksUrl) > 0 {
+			jwksUrl = string(secretJwksUrl)
+		}
+	}
+
+	// Generic OIDC providers rarely have a fixed, hardcodable endpoint, so resolve it from the issuer's
+	// discovery document instead, unless the secret or the static config already supplied explicit URLs.
+	if oauthCfg.Endpoint == (oauth2.Endpoint{}) && c.Config.ServiceProviderType == config.ServiceProviderTypeOIDC {
+		issuerUrl := c.oidcIssuerUrl(found, secret)
+		if issuerUrl == "" {
+			return nil, fmt.Errorf("the OIDC service provider configuration requires either the auth/token URLs or an issuer URL to be set")
+		}
+
+		discovery, err := discoverOidcEndpoint(ctx, issuerUrl)
+		if err != nil {
+			return nil, err
+		}
+		oauthCfg.Endpoint = discovery.Endpoint
+		if jwksUrl == "" {
+			jwksUrl = discovery.JwksURI
+		}
+	}
+
+	verifiedCfg := &VerifiedOauthConfig{Config: *oauthCfg, Verifier: c.tokenVerifier(found, secret, jwksUrl)}
+
+	if found {
+		certPEM := secret.Data[oauthCfgSecretFieldClientCert]
+		keyPEM := secret.Data[oauthCfgSecretFieldClientKey]
+		if len(certPEM) > 0 && len(keyPEM) > 0 {
+			httpClient, err := mtlsHTTPClient(oauthInfo.TokenNamespace, c.Config.ServiceProviderType, certPEM, keyPEM)
+			if err != nil {
+				return nil, err
+			}
+			verifiedCfg.HTTPClient = httpClient
+		}
+	}
+
+	return verifiedCfg, nil
+}
+
+func (c commonController) oidcIssuerUrl(found bool, secret *v1.Secret) string {
+	issuerUrl := c.Config.ServiceProviderBaseUrl
+	if found {
+		if secretIssuerUrl := secret.Data[oauthCfgSecretFieldIssuerUrl]; len(secretIssuerUrl) > 0 {
+			issuerUrl = string(secretIssuerUrl)
+		}
+	}
+	return issuerUrl
+}
+
+// tokenVerifier builds the TokenVerifier to use for tokens obtained for this service provider type, so
+// that commonController never has to hand out a raw token without a way to check its trust. Every verifier
+// is backed by the shared, process-lifetime verificationResultCache rather than one constructed here, since
+// a cache built fresh per obtainOauthConfig call (i.e. per OAuth callback) would never carry a negative
+// result across callbacks and so would never actually protect the JWKS/userinfo endpoint it exists to
+// protect.
+func (c commonController) tokenVerifier(found bool, secret *v1.Secret, jwksUrl string) TokenVerifier {
+	if c.Config.ServiceProviderType == config.ServiceProviderTypeOIDC {
+		return &JwksVerifier{
+			Issuer:   c.oidcIssuerUrl(found, secret),
+			Audience: c.Config.ClientId,
+			JwksURL:  jwksUrl,
+			Cache:    verificationResultCache,
+			CacheTTL: c.Config.TokenVerificationCacheExpiration,
+		}
+	}
+
+	// GitHub, Quay and Bitbucket all hand out opaque tokens, so the only way to check their trust is to
+	// ask the provider's userinfo-equivalent endpoint whether it still accepts them.
+	return &UserInfoVerifier{
+		UserInfoURL: c.userInfoUrl(),
+		Issuer:      string(c.Config.ServiceProviderType),
+		Cache:       verificationResultCache,
+		CacheTTL:    c.Config.TokenVerificationCacheExpiration,
+	}
+}
+
+func (c commonController) userInfoUrl() string {
+	switch c.Config.ServiceProviderType {
+	case config.ServiceProviderTypeQuay:
+		return "https://quay.io/api/v1/user/"
+	case config.ServiceProviderTypeBitbucket:
+		return "https://api.bitbucket.org/2.0/user"
+	default:
+		return "https://api.github.com/user"
+	}
+}
+
+func (c commonController) redirectUrl() string {
+	return c.BaseUrl + "/" + string(c.Config.ServiceProviderType) + "/callback"
+}
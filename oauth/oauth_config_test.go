@@ -17,6 +17,8 @@ package oauth
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
@@ -25,6 +27,7 @@ import (
 	oauthstate2 "github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/bitbucket"
 	"golang.org/x/oauth2/github"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -164,6 +167,127 @@ func TestFindOauthConfigSecret(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("exact host match wins over default secret", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithLists(&v1.SecretList{
+			Items: []v1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "default-secret",
+						Namespace: secretNamespace,
+						Labels: map[string]string{
+							v1beta1.ServiceProviderTypeLabel: string(config.ServiceProviderTypeGitHub),
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "enterprise-secret",
+						Namespace: secretNamespace,
+						Labels: map[string]string{
+							v1beta1.ServiceProviderTypeLabel: string(config.ServiceProviderTypeGitHub),
+							oauthCfgSecretLabelHost:          "github.mycompany.com",
+						},
+					},
+				},
+			},
+		}).Build()
+		ctrl := commonController{
+			Config: config.ServiceProviderConfiguration{
+				ServiceProviderType: config.ServiceProviderTypeGitHub,
+			},
+			K8sClient: cl,
+		}
+
+		oauthState := &oauthstate2.OAuthInfo{
+			TokenNamespace:      secretNamespace,
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			ServiceProviderUrl:  "https://github.mycompany.com",
+		}
+
+		found, secret, err := ctrl.findOauthConfigSecret(ctx, oauthState)
+		assert.True(t, found)
+		assert.NoError(t, err)
+		assert.Equal(t, "enterprise-secret", secret.Name)
+	})
+
+	t.Run("wildcard host match", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithLists(&v1.SecretList{
+			Items: []v1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "wildcard-secret",
+						Namespace: secretNamespace,
+						Labels: map[string]string{
+							v1beta1.ServiceProviderTypeLabel: string(config.ServiceProviderTypeQuay),
+							oauthCfgSecretLabelHost:          "*.quay.mycompany.com",
+						},
+					},
+				},
+			},
+		}).Build()
+		ctrl := commonController{
+			Config: config.ServiceProviderConfiguration{
+				ServiceProviderType: config.ServiceProviderTypeQuay,
+			},
+			K8sClient: cl,
+		}
+
+		oauthState := &oauthstate2.OAuthInfo{
+			TokenNamespace:      secretNamespace,
+			ServiceProviderType: config.ServiceProviderTypeQuay,
+			ServiceProviderUrl:  "https://registry1.quay.mycompany.com",
+		}
+
+		found, secret, err := ctrl.findOauthConfigSecret(ctx, oauthState)
+		assert.True(t, found)
+		assert.NoError(t, err)
+		assert.Equal(t, "wildcard-secret", secret.Name)
+	})
+
+	t.Run("two equally specific secrets is an error", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithLists(&v1.SecretList{
+			Items: []v1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "secret-a",
+						Namespace: secretNamespace,
+						Labels: map[string]string{
+							v1beta1.ServiceProviderTypeLabel: string(config.ServiceProviderTypeGitHub),
+							oauthCfgSecretLabelHost:          "github.mycompany.com",
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "secret-b",
+						Namespace: secretNamespace,
+						Labels: map[string]string{
+							v1beta1.ServiceProviderTypeLabel: string(config.ServiceProviderTypeGitHub),
+							oauthCfgSecretLabelHost:          "github.mycompany.com",
+						},
+					},
+				},
+			},
+		}).Build()
+		ctrl := commonController{
+			Config: config.ServiceProviderConfiguration{
+				ServiceProviderType: config.ServiceProviderTypeGitHub,
+			},
+			K8sClient: cl,
+		}
+
+		oauthState := &oauthstate2.OAuthInfo{
+			TokenNamespace:      secretNamespace,
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			ServiceProviderUrl:  "https://github.mycompany.com",
+		}
+
+		found, secret, err := ctrl.findOauthConfigSecret(ctx, oauthState)
+		assert.False(t, found)
+		assert.Nil(t, secret)
+		assert.Error(t, err)
+	})
+
 	t.Run("secret for different sp", func(t *testing.T) {
 		cl := fake.NewClientBuilder().WithScheme(scheme).WithLists(&v1.SecretList{
 			Items: []v1.Secret{
@@ -312,6 +436,104 @@ func TestObtainOauthConfig(t *testing.T) {
 		assert.Equal(t, oauthCfg.Endpoint.TokenURL, github.Endpoint.TokenURL)
 		assert.Equal(t, oauthCfg.Endpoint.AuthStyle, github.Endpoint.AuthStyle)
 		assert.Contains(t, oauthCfg.RedirectURL, "baseurl")
+		assert.NotNil(t, oauthCfg.Verifier)
+	})
+
+	t.Run("bitbucket defaults to bitbucket.org endpoint", func(t *testing.T) {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(v1.AddToScheme(scheme))
+		ctx := context.TODO()
+
+		cl := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		ctrl := commonController{
+			Config: config.ServiceProviderConfiguration{
+				ClientId:            "eh?",
+				ClientSecret:        "bleh?",
+				ServiceProviderType: config.ServiceProviderTypeBitbucket,
+			},
+			K8sClient: cl,
+			BaseUrl:   "baseurl",
+		}
+
+		oauthState := &oauthstate2.OAuthInfo{
+			ServiceProviderType: config.ServiceProviderTypeBitbucket,
+		}
+
+		oauthCfg, err := ctrl.obtainOauthConfig(ctx, oauthState)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, oauthCfg)
+		assert.Equal(t, bitbucket.Endpoint.AuthURL, oauthCfg.Endpoint.AuthURL)
+		assert.Equal(t, bitbucket.Endpoint.TokenURL, oauthCfg.Endpoint.TokenURL)
+	})
+
+	t.Run("oidc resolves endpoint from discovery document", func(t *testing.T) {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(v1.AddToScheme(scheme))
+		ctx := context.TODO()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"authorization_endpoint": "https://idp.example.com/auth", "token_endpoint": "https://idp.example.com/token", "jwks_uri": "https://idp.example.com/protocol/openid-connect/certs"}`))
+		}))
+		defer srv.Close()
+
+		cl := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		ctrl := commonController{
+			Config: config.ServiceProviderConfiguration{
+				ClientId:               "eh?",
+				ClientSecret:           "bleh?",
+				ServiceProviderType:    config.ServiceProviderTypeOIDC,
+				ServiceProviderBaseUrl: srv.URL,
+			},
+			K8sClient: cl,
+			BaseUrl:   "baseurl",
+		}
+
+		oauthState := &oauthstate2.OAuthInfo{
+			ServiceProviderType: config.ServiceProviderTypeOIDC,
+		}
+
+		oauthCfg, err := ctrl.obtainOauthConfig(ctx, oauthState)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, oauthCfg)
+		assert.Equal(t, "https://idp.example.com/auth", oauthCfg.Endpoint.AuthURL)
+		assert.Equal(t, "https://idp.example.com/token", oauthCfg.Endpoint.TokenURL)
+
+		jwksVerifier, ok := oauthCfg.Verifier.(*JwksVerifier)
+		assert.True(t, ok, "an OIDC config should be verified by a JwksVerifier")
+		assert.Equal(t, "https://idp.example.com/protocol/openid-connect/certs", jwksVerifier.JwksURL,
+			"the JWKS URL must come from the discovery document's jwks_uri, not a synthesized path")
+	})
+
+	t.Run("oidc without endpoints or issuer url fails", func(t *testing.T) {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(v1.AddToScheme(scheme))
+		ctx := context.TODO()
+
+		cl := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		ctrl := commonController{
+			Config: config.ServiceProviderConfiguration{
+				ClientId:            "eh?",
+				ClientSecret:        "bleh?",
+				ServiceProviderType: config.ServiceProviderTypeOIDC,
+			},
+			K8sClient: cl,
+			BaseUrl:   "baseurl",
+		}
+
+		oauthState := &oauthstate2.OAuthInfo{
+			ServiceProviderType: config.ServiceProviderTypeOIDC,
+		}
+
+		oauthCfg, err := ctrl.obtainOauthConfig(ctx, oauthState)
+
+		assert.Error(t, err)
+		assert.Nil(t, oauthCfg)
 	})
 
 	t.Run("use oauth config from secret", func(t *testing.T) {
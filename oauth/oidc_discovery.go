@@ -0,0 +1,103 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	oauthCfgSecretFieldIssuerUrl = "issuerUrl"
+
+	oidcWellKnownPath     = "/.well-known/openid-configuration"
+	oidcDiscoveryCacheTTL = 1 * time.Hour
+)
+
+// oidcDiscoveryDocument is the subset of the OIDC discovery document (as served at
+// {issuer}/.well-known/openid-configuration) that we care about.
+type oidcDiscoveryDocument struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// oidcDiscoveryResult is the subset of the discovery document discoverOidcEndpoint resolves and caches:
+// the OAuth endpoint and the JWKS URL. The JWKS URL is not derivable from the issuer URL by convention -
+// Keycloak, Okta and Dex all serve it at different, provider-specific paths - so it must come from the
+// discovery document rather than being synthesized.
+type oidcDiscoveryResult struct {
+	Endpoint oauth2.Endpoint
+	JwksURI  string
+}
+
+type oidcDiscoveryCacheEntry struct {
+	result  oidcDiscoveryResult
+	expires time.Time
+}
+
+// oidcDiscoveryCache caches the resolved discovery result per issuer URL so that a token exchange doesn't
+// have to re-fetch the discovery document every time.
+var oidcDiscoveryCache sync.Map // map[string]oidcDiscoveryCacheEntry
+
+// discoverOidcEndpoint resolves the auth/token URLs and JWKS URL of the OIDC provider identified by
+// issuerUrl by fetching its well-known discovery document, caching the result for oidcDiscoveryCacheTTL.
+func discoverOidcEndpoint(ctx context.Context, issuerUrl string) (oidcDiscoveryResult, error) {
+	if cached, ok := oidcDiscoveryCache.Load(issuerUrl); ok {
+		entry := cached.(oidcDiscoveryCacheEntry)
+		if time.Now().Before(entry.expires) {
+			return entry.result, nil
+		}
+		oidcDiscoveryCache.Delete(issuerUrl)
+	}
+
+	discoveryUrl := strings.TrimSuffix(issuerUrl, "/") + oidcWellKnownPath
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryUrl, nil)
+	if err != nil {
+		return oidcDiscoveryResult{}, fmt.Errorf("failed to construct the OIDC discovery request for %s: %w", issuerUrl, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return oidcDiscoveryResult{}, fmt.Errorf("failed to fetch the OIDC discovery document from %s: %w", discoveryUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return oidcDiscoveryResult{}, fmt.Errorf("unexpected status %d when fetching the OIDC discovery document from %s", resp.StatusCode, discoveryUrl)
+	}
+
+	doc := oidcDiscoveryDocument{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return oidcDiscoveryResult{}, fmt.Errorf("failed to decode the OIDC discovery document from %s: %w", discoveryUrl, err)
+	}
+
+	result := oidcDiscoveryResult{
+		Endpoint: oauth2.Endpoint{AuthURL: doc.AuthorizationEndpoint, TokenURL: doc.TokenEndpoint},
+		JwksURI:  doc.JwksUri,
+	}
+
+	oidcDiscoveryCache.Store(issuerUrl, oidcDiscoveryCacheEntry{result: result, expires: time.Now().Add(oidcDiscoveryCacheTTL)})
+
+	return result, nil
+}
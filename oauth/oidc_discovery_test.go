@@ -0,0 +1,49 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverOidcEndpoint(t *testing.T) {
+	requests := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/.well-known/openid-configuration", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"authorization_endpoint": "https://idp.example.com/auth", "token_endpoint": "https://idp.example.com/token", "jwks_uri": "https://idp.example.com/protocol/openid-connect/certs"}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.TODO()
+
+	result, err := discoverOidcEndpoint(ctx, srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com/auth", result.Endpoint.AuthURL)
+	assert.Equal(t, "https://idp.example.com/token", result.Endpoint.TokenURL)
+	assert.Equal(t, "https://idp.example.com/protocol/openid-connect/certs", result.JwksURI)
+
+	// a second call for the same issuer must be served from the cache
+	_, err = discoverOidcEndpoint(ctx, srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+}
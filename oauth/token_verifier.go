@@ -0,0 +1,360 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultVerificationCacheExpiration is used when ServiceProviderConfiguration.TokenVerificationCacheExpiration
+// isn't set.
+const defaultVerificationCacheExpiration = 30 * time.Second
+
+// maxVerificationCacheEntries bounds how many verification results verificationResultCache holds at once,
+// so that a flood of distinct replayed tokens can't grow the cache without limit while entries are still
+// waiting out their TTL.
+const maxVerificationCacheEntries = 10000
+
+// TokenVerifier lets downstream code validate an OAuth access/ID token against the service provider that
+// issued it, uniformly across providers that hand out opaque tokens (GitHub, Quay) and ones that hand out
+// JWTs that can be checked against a JWKS document (OIDC).
+type TokenVerifier interface {
+	Verify(ctx context.Context, rawToken string) error
+}
+
+type verificationCacheKey struct {
+	jkt string
+	iss string
+}
+
+type verificationCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// verificationCache is a small sync.Map-backed, size-bounded cache of verification results (including
+// negative ones, so that a flood of replayed callbacks can't DOS the JWKS/userinfo endpoint), keyed by
+// (jkt, iss). It must be shared across requests - a cache that's rebuilt per request never serves anything
+// from the negative-result path it exists for - so verificationResultCache below is the only instance
+// TokenVerifier implementations are given.
+type verificationCache struct {
+	store sync.Map // map[verificationCacheKey]verificationCacheEntry
+	size  int64
+}
+
+// verificationResultCache is shared by every TokenVerifier for the lifetime of the process, so that the
+// negative-result cache actually protects the JWKS/userinfo endpoint across OAuth callbacks instead of
+// starting out empty on every obtainOauthConfig call.
+var verificationResultCache = newVerificationCache()
+
+func newVerificationCache() *verificationCache {
+	return &verificationCache{}
+}
+
+func (c *verificationCache) get(key verificationCacheKey) (error, bool) {
+	cached, ok := c.store.Load(key)
+	if !ok {
+		return nil, false
+	}
+
+	entry := cached.(verificationCacheEntry)
+	if time.Now().After(entry.expires) {
+		if _, deleted := c.store.LoadAndDelete(key); deleted {
+			atomic.AddInt64(&c.size, -1)
+		}
+		return nil, false
+	}
+
+	return entry.err, true
+}
+
+func (c *verificationCache) put(key verificationCacheKey, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultVerificationCacheExpiration
+	}
+
+	if _, loaded := c.store.Load(key); !loaded {
+		if atomic.AddInt64(&c.size, 1) > maxVerificationCacheEntries {
+			c.evictOne()
+		}
+	}
+
+	c.store.Store(key, verificationCacheEntry{err: err, expires: time.Now().Add(ttl)})
+}
+
+// evictOne drops a single entry to keep the cache within maxVerificationCacheEntries. sync.Map doesn't
+// track access recency, so this isn't a strict LRU eviction - it's whichever entry Range happens to visit
+// first - but it's enough to stop unbounded growth from an endless stream of distinct tokens.
+func (c *verificationCache) evictOne() {
+	c.store.Range(func(k, _ interface{}) bool {
+		if _, deleted := c.store.LoadAndDelete(k); deleted {
+			atomic.AddInt64(&c.size, -1)
+		}
+		return false
+	})
+}
+
+// UserInfoVerifier verifies an opaque access token by calling a provider's userinfo-equivalent endpoint
+// with it and trusting a 200 response. This is what GitHub and Quay fall back to, since their tokens
+// aren't JWTs that could be checked against a JWKS document.
+type UserInfoVerifier struct {
+	UserInfoURL string
+	Issuer      string
+	Cache       *verificationCache
+	CacheTTL    time.Duration
+	HTTPClient  *http.Client
+}
+
+func (v *UserInfoVerifier) Verify(ctx context.Context, rawToken string) error {
+	key := verificationCacheKey{jkt: hashToken(rawToken), iss: v.Issuer}
+	if cachedErr, ok := v.Cache.get(key); ok {
+		return cachedErr
+	}
+
+	err := v.verify(ctx, rawToken)
+	v.Cache.put(key, err, v.CacheTTL)
+	return err
+}
+
+func (v *UserInfoVerifier) verify(ctx context.Context, rawToken string) error {
+	httpClient := v.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.UserInfoURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to construct the userinfo request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+rawToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call the userinfo endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token rejected by the userinfo endpoint with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func hashToken(rawToken string) string {
+	sum := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// jwtClaims is the subset of JWT claims JwksVerifier validates.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  interface{} `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+}
+
+func decodeJwtClaims(rawToken string) (*jwtClaims, string, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, "", fmt.Errorf("not a JWT: expected 3 dot-separated parts, got %d", len(parts))
+	}
+
+	header := struct {
+		Kid string `json:"kid"`
+	}{}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode the JWT header: %w", err)
+	}
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return nil, "", fmt.Errorf("failed to parse the JWT header: %w", err)
+	}
+
+	payloadJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode the JWT payload: %w", err)
+	}
+
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payloadJson, claims); err != nil {
+		return nil, "", fmt.Errorf("failed to parse the JWT payload: %w", err)
+	}
+
+	return claims, header.Kid, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwksDocument struct {
+	Keys []jwk `json:"keys"`
+}
+
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK modulus: %w", err)
+	}
+
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
+
+func verifyRS256(rawToken string, key *rsa.PublicKey) error {
+	parts := strings.Split(rawToken, ".")
+	signedPart := parts[0] + "." + parts[1]
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid JWT signature encoding: %w", err)
+	}
+
+	digest := sha256.Sum256([]byte(signedPart))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+}
+
+func audienceContains(aud interface{}, expected string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// JwksVerifier verifies a JWT access/ID token against the issuer's JWKS document: the signature, the
+// issuer, the audience and the exp/nbf validity window.
+type JwksVerifier struct {
+	Issuer     string
+	Audience   string
+	JwksURL    string
+	Cache      *verificationCache
+	CacheTTL   time.Duration
+	HTTPClient *http.Client
+}
+
+func (v *JwksVerifier) Verify(ctx context.Context, rawToken string) error {
+	claims, kid, err := decodeJwtClaims(rawToken)
+	if err != nil {
+		return err
+	}
+
+	// The cache key must identify this specific token, not just the signing key (kid) and issuer it
+	// claims to be from — those are shared by every token a given issuer mints with that key, so keying
+	// on them would let one cached success (or failure) apply to any other token with the same header,
+	// skipping its own signature/exp/nbf/aud checks entirely.
+	key := verificationCacheKey{jkt: hashToken(rawToken), iss: claims.Issuer}
+	if cachedErr, ok := v.Cache.get(key); ok {
+		return cachedErr
+	}
+
+	err = v.verify(ctx, rawToken, claims, kid)
+	v.Cache.put(key, err, v.CacheTTL)
+	return err
+}
+
+func (v *JwksVerifier) verify(ctx context.Context, rawToken string, claims *jwtClaims, kid string) error {
+	httpClient := v.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.JwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to construct the JWKS request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the JWKS document from %s: %w", v.JwksURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d when fetching the JWKS document from %s", resp.StatusCode, v.JwksURL)
+	}
+
+	doc := jwksDocument{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to decode the JWKS document from %s: %w", v.JwksURL, err)
+	}
+
+	var matchedKey *jwk
+	for i := range doc.Keys {
+		if doc.Keys[i].Kid == kid {
+			matchedKey = &doc.Keys[i]
+			break
+		}
+	}
+	if matchedKey == nil {
+		return fmt.Errorf("no JWKS key found matching kid %q", kid)
+	}
+
+	pubKey, err := matchedKey.publicKey()
+	if err != nil {
+		return err
+	}
+
+	if err := verifyRS256(rawToken, pubKey); err != nil {
+		return fmt.Errorf("token signature verification failed: %w", err)
+	}
+
+	if claims.Issuer != v.Issuer {
+		return fmt.Errorf("unexpected token issuer %q, expected %q", claims.Issuer, v.Issuer)
+	}
+
+	if !audienceContains(claims.Audience, v.Audience) {
+		return fmt.Errorf("token audience does not contain %q", v.Audience)
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return fmt.Errorf("token has expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	return nil
+}
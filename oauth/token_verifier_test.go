@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signTestJwt(t *testing.T, key *rsa.PrivateKey, kid string, claims jwtClaims) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	assert.NoError(t, err)
+
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+
+	signedPart := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signedPart))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+
+	return signedPart + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestUserInfoVerifierCachesNegativeResult(t *testing.T) {
+	requests := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	verifier := &UserInfoVerifier{
+		UserInfoURL: srv.URL,
+		Issuer:      "github",
+		Cache:       newVerificationCache(),
+		CacheTTL:    time.Minute,
+	}
+
+	ctx := context.TODO()
+
+	err1 := verifier.Verify(ctx, "some-token")
+	assert.Error(t, err1)
+
+	err2 := verifier.Verify(ctx, "some-token")
+	assert.Error(t, err2)
+
+	assert.Equal(t, 1, requests, "the second verification should have been served from the negative-result cache")
+}
+
+func TestJwksVerifierDoesNotCacheAcrossDifferentTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	const kid = "shared-kid"
+	const issuer = "https://idp.example.com"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"keys": [{"kid": "` + kid + `", "n": "` +
+			base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()) + `", "e": "` +
+			base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}) + `"}]}`))
+	}))
+	defer srv.Close()
+
+	verifier := &JwksVerifier{
+		Issuer:   issuer,
+		Audience: "my-client",
+		JwksURL:  srv.URL,
+		Cache:    newVerificationCache(),
+		CacheTTL: time.Minute,
+	}
+
+	ctx := context.TODO()
+	now := time.Now()
+
+	validToken := signTestJwt(t, key, kid, jwtClaims{
+		Issuer:    issuer,
+		Audience:  "my-client",
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	})
+	assert.NoError(t, verifier.Verify(ctx, validToken))
+
+	// Same kid and iss as validToken, but expired: this must be checked on its own merits, not treated as
+	// trusted just because a different token with the same (kid, iss) was cached as valid.
+	expiredToken := signTestJwt(t, key, kid, jwtClaims{
+		Issuer:    issuer,
+		Audience:  "my-client",
+		ExpiresAt: now.Add(-time.Hour).Unix(),
+	})
+	assert.Error(t, verifier.Verify(ctx, expiredToken))
+}
+
+func TestVerificationCacheExpires(t *testing.T) {
+	cache := newVerificationCache()
+	key := verificationCacheKey{jkt: "kid", iss: "iss"}
+
+	cache.put(key, nil, time.Millisecond)
+
+	_, ok := cache.get(key)
+	assert.True(t, ok)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok = cache.get(key)
+	assert.False(t, ok, "the cache entry should have expired")
+}
+
+func TestVerificationCacheEvictsOnceFull(t *testing.T) {
+	cache := newVerificationCache()
+
+	for i := 0; i < maxVerificationCacheEntries+1; i++ {
+		cache.put(verificationCacheKey{jkt: string(rune(i)), iss: "iss"}, nil, time.Minute)
+	}
+
+	var stored int64
+	cache.store.Range(func(_, _ interface{}) bool {
+		stored++
+		return true
+	})
+
+	assert.LessOrEqual(t, stored, int64(maxVerificationCacheEntries), "the cache should not grow past its bound")
+}
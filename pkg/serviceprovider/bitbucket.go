@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ ServiceProvider = (*Bitbucket)(nil)
+
+// workspaceMembershipCacheTTL bounds how long we trust a previously fetched Bitbucket workspace
+// membership list for a given access token before asking the Bitbucket API again.
+const workspaceMembershipCacheTTL = 5 * time.Minute
+
+// WorkspaceMap maps a Bitbucket workspace slug to the set of permission scopes that membership in it
+// grants, mirroring TeamMap's org/team policy mapping for Github.
+type WorkspaceMap map[string][]string
+
+// grants reports whether any of the workspaces the user belongs to is mapped to a set of scopes that
+// covers all of requiredScopes.
+func (m WorkspaceMap) grants(workspaces []string, requiredScopes []string) bool {
+	if len(requiredScopes) == 0 {
+		return len(workspaces) > 0
+	}
+
+	for _, workspace := range workspaces {
+		if containsAll(m[workspace], requiredScopes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type workspaceMembershipCacheEntry struct {
+	workspaces []string
+	expires    time.Time
+}
+
+type Bitbucket struct {
+	Client       client.Client
+	TokenStorage tokenstorage.TokenStorage
+	WorkspaceMap WorkspaceMap
+
+	membershipCache sync.Map // keyed by the access token value, holds workspaceMembershipCacheEntry
+}
+
+// NewBitbucket builds a Bitbucket service provider. workspaceMap is mandatory for the same reason
+// Github's TeamMap is: without at least one workspace mapped to a set of scopes, LookupToken could never
+// find an SPIAccessToken whose workspace membership grants the permissions a binding requires.
+func NewBitbucket(cl client.Client, tokenStorage tokenstorage.TokenStorage, workspaceMap WorkspaceMap) (*Bitbucket, error) {
+	if len(workspaceMap) == 0 {
+		return nil, fmt.Errorf("WorkspaceMap must map at least one Bitbucket workspace to the scopes membership in it grants")
+	}
+
+	return &Bitbucket{
+		Client:       cl,
+		TokenStorage: tokenStorage,
+		WorkspaceMap: workspaceMap,
+	}, nil
+}
+
+// LookupToken returns the namespace's SPIAccessToken whose granted scopes cover the binding's required
+// permissions and whose owner belongs to a Bitbucket workspace that WorkspaceMap also maps to those
+// permissions, mirroring Github.LookupToken's scope-and-membership check.
+func (b *Bitbucket) LookupToken(ctx context.Context, binding *api.SPIAccessTokenBinding) (*api.SPIAccessToken, error) {
+	ats := &api.SPIAccessTokenList{}
+	if err := b.Client.List(ctx, ats, client.InNamespace(binding.Namespace)); err != nil {
+		return nil, err
+	}
+
+	requiredScopes := requiredScopesForBinding(binding)
+
+	for i := range ats.Items {
+		token := &ats.Items[i]
+
+		if !containsAll(scopesGrantedByToken(token), requiredScopes) {
+			continue
+		}
+
+		storedToken, err := b.TokenStorage.Get(ctx, token)
+		if err != nil || storedToken == nil {
+			continue
+		}
+
+		workspaces, err := b.workspacesFor(ctx, storedToken.AccessToken)
+		if err != nil {
+			continue
+		}
+
+		if b.WorkspaceMap.grants(workspaces, requiredScopes) {
+			return token, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no SPIAccessToken found whose granted scopes and Bitbucket workspace membership together grant the required permissions %v", requiredScopes)
+}
+
+type bitbucketWorkspace struct {
+	Slug string `json:"slug"`
+}
+
+type bitbucketWorkspacesResponse struct {
+	Values []bitbucketWorkspace `json:"values"`
+}
+
+// workspacesFor calls the Bitbucket API with the given access token to list the workspaces its owner
+// belongs to, caching the result for workspaceMembershipCacheTTL.
+func (b *Bitbucket) workspacesFor(ctx context.Context, accessToken string) ([]string, error) {
+	if cached, ok := b.membershipCache.Load(accessToken); ok {
+		entry := cached.(workspaceMembershipCacheEntry)
+		if time.Now().Before(entry.expires) {
+			return entry.workspaces, nil
+		}
+		b.membershipCache.Delete(accessToken)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.bitbucket.org/2.0/workspaces?role=member", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct the Bitbucket workspace membership request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the Bitbucket user's workspaces: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d when listing the Bitbucket user's workspaces", resp.StatusCode)
+	}
+
+	var body bitbucketWorkspacesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode the Bitbucket workspace membership response: %w", err)
+	}
+
+	workspaces := make([]string, 0, len(body.Values))
+	for _, w := range body.Values {
+		workspaces = append(workspaces, w.Slug)
+	}
+
+	b.membershipCache.Store(accessToken, workspaceMembershipCacheEntry{workspaces: workspaces, expires: time.Now().Add(workspaceMembershipCacheTTL)})
+
+	return workspaces, nil
+}
+
+// GetServiceProviderUrlForRepo returns the scheme and host of repoUrl. This is enough to identify both
+// bitbucket.org/{workspace}/{repo} repositories and the on-prem Bitbucket Server
+// /projects/{key}/repos/{slug} ones, because in both cases the OAuth config and host-matching only ever
+// care about the service provider's host, not the shape of the repository path.
+func (b *Bitbucket) GetServiceProviderUrlForRepo(repoUrl string) (string, error) {
+	return getHostWithScheme(repoUrl)
+}
@@ -16,34 +16,243 @@ package serviceprovider
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var _ ServiceProvider = (*Github)(nil)
 
+// teamMembershipCacheTTL bounds how long we trust a previously fetched org/team membership list for a
+// given access token before asking the GitHub API again.
+const teamMembershipCacheTTL = 5 * time.Minute
+
+// TeamMap maps an "org" or "org:team" key to the set of permission scopes that membership in it grants,
+// mirroring the policy mapping of Vault's GitHub auth backend.
+type TeamMap map[string][]string
+
+// grants reports whether any of the orgs/teams the user belongs to is mapped to a set of scopes that
+// covers all of requiredScopes.
+func (m TeamMap) grants(orgsAndTeams []string, requiredScopes []string) bool {
+	if len(requiredScopes) == 0 {
+		// A binding that requires no permissions has nothing for a mapped scope list to cover, so any
+		// recorded org/team membership satisfies it; a token whose owner belongs to nothing still doesn't
+		// match, since there's no membership to vouch for it at all.
+		return len(orgsAndTeams) > 0
+	}
+
+	for _, orgOrTeam := range orgsAndTeams {
+		if containsAll(m[orgOrTeam], requiredScopes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsAll(haystack []string, needles []string) bool {
+	set := make(map[string]bool, len(haystack))
+	for _, h := range haystack {
+		set[h] = true
+	}
+
+	for _, n := range needles {
+		if !set[n] {
+			return false
+		}
+	}
+
+	return true
+}
+
+type membershipCacheEntry struct {
+	orgsAndTeams []string
+	expires      time.Time
+}
+
 type Github struct {
-	Client client.Client
+	Client       client.Client
+	TokenStorage tokenstorage.TokenStorage
+	TeamMap      TeamMap
+
+	membershipCache sync.Map // keyed by the access token value, holds membershipCacheEntry
 }
 
-func (g *Github) LookupToken(ctx context.Context, binding *api.SPIAccessTokenBinding) (*api.SPIAccessToken, error) {
-	// TODO implement
+// NewGithub builds a Github service provider. teamMap is mandatory: without any org/team policy mapped to
+// a set of scopes, LookupToken could never find an SPIAccessToken whose org/team membership grants the
+// permissions a binding requires, so a Github with an empty TeamMap would reject every binding that
+// requires any permission.
+func NewGithub(client client.Client, tokenStorage tokenstorage.TokenStorage, teamMap TeamMap) (*Github, error) {
+	if len(teamMap) == 0 {
+		return nil, fmt.Errorf("TeamMap must map at least one GitHub org or org:team to the scopes membership in it grants")
+	}
+
+	return &Github{
+		Client:       client,
+		TokenStorage: tokenStorage,
+		TeamMap:      teamMap,
+	}, nil
+}
 
-	// for now just return the first SPIAccessToken that we find so that we prevent infinitely many SPIAccessTokens
-	// being created during the tests :)
+func (g *Github) LookupToken(ctx context.Context, binding *api.SPIAccessTokenBinding) (*api.SPIAccessToken, error) {
 	ats := &api.SPIAccessTokenList{}
-	if err := g.Client.List(ctx, ats, client.Limit(1)); err != nil {
+	if err := g.Client.List(ctx, ats, client.InNamespace(binding.Namespace)); err != nil {
+		return nil, err
+	}
+
+	requiredScopes := requiredScopesForBinding(binding)
+
+	for i := range ats.Items {
+		token := &ats.Items[i]
+
+		if !containsAll(scopesGrantedByToken(token), requiredScopes) {
+			continue
+		}
+
+		storedToken, err := g.TokenStorage.Get(ctx, token)
+		if err != nil || storedToken == nil {
+			continue
+		}
+
+		orgsAndTeams, err := g.orgsAndTeamsFor(ctx, storedToken.AccessToken)
+		if err != nil {
+			continue
+		}
+
+		if g.TeamMap.grants(orgsAndTeams, requiredScopes) {
+			return token, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no SPIAccessToken found whose granted scopes and GitHub org/team membership together grant the required permissions %v", requiredScopes)
+}
+
+func requiredScopesForBinding(binding *api.SPIAccessTokenBinding) []string {
+	return scopesFromPermissions(binding.Spec.Permissions.Required)
+}
+
+// scopesGrantedByToken reports the scopes an SPIAccessToken was actually granted, as recorded in its
+// status when it was linked. A token that was never granted a required scope must not be handed out for a
+// binding that requires it, regardless of its owner's org/team membership.
+func scopesGrantedByToken(token *api.SPIAccessToken) []string {
+	return scopesFromPermissions(token.Status.Permissions.Required)
+}
+
+func scopesFromPermissions(perms []api.Permission) []string {
+	scopes := make([]string, 0, len(perms))
+	for _, p := range perms {
+		scopes = append(scopes, fmt.Sprintf("%s:%s", p.Area, p.Type))
+	}
+	return scopes
+}
+
+type githubTeam struct {
+	Slug         string `json:"slug"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
+type githubOrg struct {
+	Login string `json:"login"`
+}
+
+// orgsAndTeamsFor calls the GitHub API with the given access token to list the orgs and teams its owner
+// belongs to, returning both the bare org logins (e.g. "my-org") and the "org:team" slugs (e.g.
+// "my-org:my-team"), caching the result for teamMembershipCacheTTL.
+//
+// Both /user/teams and /user/orgs are listed: a user can belong to an org without belonging to any team in
+// it, in which case only /user/orgs would report that org, so relying on /user/teams alone would make a
+// bare-org TeamMap key unmatchable for such a user.
+func (g *Github) orgsAndTeamsFor(ctx context.Context, accessToken string) ([]string, error) {
+	if cached, ok := g.membershipCache.Load(accessToken); ok {
+		entry := cached.(membershipCacheEntry)
+		if time.Now().Before(entry.expires) {
+			return entry.orgsAndTeams, nil
+		}
+		g.membershipCache.Delete(accessToken)
+	}
+
+	teams, err := g.userTeams(ctx, accessToken)
+	if err != nil {
 		return nil, err
 	}
 
-	if len(ats.Items) == 0 {
-		return nil, nil
+	orgs, err := g.userOrgs(ctx, accessToken)
+	if err != nil {
+		return nil, err
 	}
 
-	return &ats.Items[0], nil
+	seenOrgs := map[string]bool{}
+	orgsAndTeams := make([]string, 0, len(teams)*2+len(orgs))
+	for _, t := range teams {
+		if !seenOrgs[t.Organization.Login] {
+			seenOrgs[t.Organization.Login] = true
+			orgsAndTeams = append(orgsAndTeams, t.Organization.Login)
+		}
+		orgsAndTeams = append(orgsAndTeams, t.Organization.Login+":"+t.Slug)
+	}
+	for _, o := range orgs {
+		if !seenOrgs[o.Login] {
+			seenOrgs[o.Login] = true
+			orgsAndTeams = append(orgsAndTeams, o.Login)
+		}
+	}
+
+	g.membershipCache.Store(accessToken, membershipCacheEntry{orgsAndTeams: orgsAndTeams, expires: time.Now().Add(teamMembershipCacheTTL)})
+
+	return orgsAndTeams, nil
+}
+
+func (g *Github) userTeams(ctx context.Context, accessToken string) ([]githubTeam, error) {
+	var teams []githubTeam
+	if err := getGithubUserList(ctx, accessToken, "https://api.github.com/user/teams", &teams); err != nil {
+		return nil, fmt.Errorf("failed to list the GitHub user's teams: %w", err)
+	}
+	return teams, nil
+}
+
+func (g *Github) userOrgs(ctx context.Context, accessToken string) ([]githubOrg, error) {
+	var orgs []githubOrg
+	if err := getGithubUserList(ctx, accessToken, "https://api.github.com/user/orgs", &orgs); err != nil {
+		return nil, fmt.Errorf("failed to list the GitHub user's orgs: %w", err)
+	}
+	return orgs, nil
+}
+
+// getGithubUserList calls a paginated-but-here-treated-as-single-page GitHub "list the current user's X"
+// endpoint and decodes the JSON array response into out.
+func getGithubUserList(ctx context.Context, accessToken string, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to construct the request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode the response from %s: %w", url, err)
+	}
+
+	return nil
 }
 
 func (g *Github) GetServiceProviderUrlForRepo(repoUrl string) (string, error) {
 	return getHostWithScheme(repoUrl)
-}
\ No newline at end of file
+}